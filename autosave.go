@@ -0,0 +1,151 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AutoSaveOptions controls the background save loop started by
+// Jar.StartAutoSave.
+type AutoSaveOptions struct {
+	// MinInterval debounces saves: once a cookie changes, wait at
+	// least this long for more changes to arrive before saving, so
+	// a page load that fires many SetCookies coalesces into one
+	// Save. Zero means save as soon as anything is dirty.
+	MinInterval time.Duration
+
+	// MaxInterval forces a save at least this often even if nothing
+	// is known to be dirty, to guard against clock drift between
+	// processes and to pick up any file rotation. Defaults to one
+	// hour if zero.
+	MaxInterval time.Duration
+
+	// OnError, if non-nil, is called with the error from any
+	// background Save that fails. It's never called for the final
+	// flush performed by Stop, whose error is returned directly.
+	OnError func(error)
+}
+
+// AutoSaver is returned by Jar.StartAutoSave and controls the
+// background save loop it started.
+type AutoSaver struct {
+	jar    *Jar
+	opts   AutoSaveOptions
+	cancel context.CancelFunc
+	dirty  chan struct{}
+	done   chan struct{}
+
+	mu       sync.Mutex
+	flushErr error
+}
+
+// StartAutoSave spawns a goroutine that periodically calls j.Save
+// so that callers of SetCookies don't need to call it themselves.
+// Mutations coalesce into a single Save per debounce window (see
+// AutoSaveOptions.MinInterval); Stop (or cancelling ctx) performs a
+// final synchronous flush and waits for it before returning.
+func (j *Jar) StartAutoSave(ctx context.Context, opts AutoSaveOptions) *AutoSaver {
+	ctx, cancel := context.WithCancel(ctx)
+	a := &AutoSaver{
+		jar:    j,
+		opts:   opts,
+		cancel: cancel,
+		dirty:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	j.mu.Lock()
+	j.autoSave = a
+	j.mu.Unlock()
+	go a.run(ctx)
+	return a
+}
+
+// Stop ends the background save loop, performs a final synchronous
+// flush, and waits for it to complete before returning its error.
+func (a *AutoSaver) Stop() error {
+	a.cancel()
+	<-a.done
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.flushErr
+}
+
+// signalDirty wakes the save loop; it's called by noteDirty and
+// noteDeleted, so any mutation made through the normal entry-mutating
+// paths (e.g. SetCookies) is picked up without callers doing
+// anything extra.
+func (a *AutoSaver) signalDirty() {
+	select {
+	case a.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (a *AutoSaver) run(ctx context.Context) {
+	defer close(a.done)
+
+	maxInterval := a.opts.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = time.Hour
+	}
+	maxTimer := time.NewTimer(maxInterval)
+	defer maxTimer.Stop()
+
+	var minTimer <-chan time.Time
+	pending := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			err := a.jar.Save()
+			a.mu.Lock()
+			a.flushErr = err
+			a.mu.Unlock()
+			return
+
+		case <-a.dirty:
+			pending = true
+			if a.opts.MinInterval <= 0 {
+				a.save()
+				pending = false
+				resetTimer(maxTimer, maxInterval)
+			} else if minTimer == nil {
+				minTimer = time.After(a.opts.MinInterval)
+			}
+
+		case <-minTimer:
+			minTimer = nil
+			if pending {
+				a.save()
+				pending = false
+				resetTimer(maxTimer, maxInterval)
+			}
+
+		case <-maxTimer.C:
+			a.save()
+			pending = false
+			resetTimer(maxTimer, maxInterval)
+		}
+	}
+}
+
+func (a *AutoSaver) save() {
+	if err := a.jar.Save(); err != nil && a.opts.OnError != nil {
+		a.opts.OnError(err)
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
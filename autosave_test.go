@@ -0,0 +1,52 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAutoSaveDebouncesAndStopFlushes(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cookies.json")
+
+	jar, err := New(&Options{Filename: filename})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	a := jar.StartAutoSave(context.Background(), AutoSaveOptions{
+		MinInterval: time.Hour,
+		MaxInterval: time.Hour,
+	})
+
+	u := mustURL(t, "http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1", MaxAge: 3600}})
+
+	// With MinInterval an hour away, nothing should be on disk yet.
+	if fi, err := os.Stat(filename); err == nil && fi.Size() > 0 {
+		t.Fatalf("cookie file written before debounce interval elapsed")
+	}
+
+	if err := a.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	// Stop must have performed a final synchronous flush regardless of
+	// the debounce interval.
+	jar2, err := New(&Options{Filename: filename})
+	if err != nil {
+		t.Fatalf("New (reload): %v", err)
+	}
+	got := jar2.Cookies(u)
+	if len(got) != 1 || got[0].Value != "1" {
+		t.Fatalf("unexpected cookies after Stop flush: %v", got)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+
+	"gopkg.in/errgo.v1"
+)
+
+// KeyPair holds one generation of keys used to authenticate and
+// encrypt the cookie file, analogous to gorilla/securecookie's
+// rotating key pairs. HashKey must be 32 bytes long and is used for
+// HMAC-SHA256 authentication of the file header and ciphertext;
+// BlockKey must be 32 bytes long and is used as the AES-256 key for
+// AES-GCM encryption.
+//
+// ID distinguishes one generation of keys from another in the file
+// header, so that cookie files written before a key rotation can
+// still be decrypted with an older key.
+type KeyPair struct {
+	ID       byte
+	HashKey  []byte
+	BlockKey []byte
+}
+
+// EncryptOptions controls NewEncrypted's behaviour. A nil
+// *EncryptOptions is equivalent to a zero EncryptOptions.
+type EncryptOptions struct {
+	// Compress, if true, gzip-compresses the plaintext before
+	// encrypting it (and decompresses after decrypting). Off by
+	// default: it only helps when the plaintext cookie set is large
+	// enough for gzip's overhead to pay for itself. It only affects
+	// writing: the compressed flag travels in the authenticated file
+	// header, so a jar decompresses a file whenever that flag is set,
+	// whatever its own Compress setting.
+	Compress bool
+}
+
+const (
+	encryptedMagic = "PCJ1"
+	nonceSize      = 12
+
+	// encryptedVersionPlain is the original header layout: magic,
+	// version, key id, nonce. Still understood on read so files
+	// written before compression support existed keep decrypting.
+	encryptedVersionPlain = 1
+	headerSizePlain       = len(encryptedMagic) + 2 + nonceSize
+
+	// encryptedVersionFlags adds a flags byte (currently only
+	// flagCompressed) between the key id and the nonce. This is the
+	// version every encryptBytes call now writes.
+	encryptedVersionFlags = 2
+	headerSizeFlags       = len(encryptedMagic) + 3 + nonceSize
+)
+
+const flagCompressed byte = 1 << 0
+
+// NewEncrypted returns a new Jar that persists its cookies to
+// filename encrypted at rest. keys[0] is used to encrypt the file on
+// every Save; when decrypting, the first key whose ID matches the key
+// ID in the file header is used and no other key is tried, so old
+// keys (with IDs distinct from the new one) can be kept around to
+// make rotation with RotateKeys seamless.
+// Files that don't start with the encrypted header are assumed to be
+// plain JSON, so a jar can be switched over to encryption without
+// losing cookies already saved by an older version. opts may be nil.
+func NewEncrypted(filename string, keys []KeyPair, opts *EncryptOptions) (*Jar, error) {
+	if len(keys) == 0 {
+		return nil, errgo.New("no keys provided")
+	}
+	j := newJar(&Options{Filename: filename})
+	j.keys = keys
+	if opts != nil {
+		j.compress = opts.Compress
+	}
+	if err := j.load(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return j, nil
+}
+
+// RotateKeys replaces the keys used by j with keys and immediately
+// rewrites the cookie file so that every entry on disk is encrypted
+// under keys[0] rather than whatever key last wrote it. Callers
+// should keep the previous key in keys (after the new one) until
+// they're sure every jar sharing the file has rotated.
+func (j *Jar) RotateKeys(keys []KeyPair) error {
+	if len(keys) == 0 {
+		return errgo.New("no keys provided")
+	}
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return j.Save()
+}
+
+func keyByID(keys []KeyPair, id byte) (KeyPair, bool) {
+	for _, k := range keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return KeyPair{}, false
+}
+
+// encryptFileHeader serializes fh to JSON and returns the
+// base64-encoded, authenticated-encrypted file contents, encrypted
+// with keys[0].
+func encryptFileHeader(fh fileHeader, keys []KeyPair, compress bool) ([]byte, error) {
+	plain, err := json.Marshal(fh)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return encryptBytes(plain, keys, compress)
+}
+
+// encryptBytes returns the base64-encoded, authenticated-encrypted
+// form of plain, encrypted with keys[0] and gzip-compressed first if
+// compress is true; it's the shared primitive behind
+// encryptFileHeader and the journal's per-record encryption.
+func encryptBytes(plain []byte, keys []KeyPair, compress bool) ([]byte, error) {
+	var flags byte
+	if compress {
+		compressed, err := gzipCompress(plain)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		plain = compressed
+		flags |= flagCompressed
+	}
+
+	key := keys[0]
+	block, err := aes.NewCipher(key.BlockKey)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid block key")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ciphertext := gcm.Seal(nil, nonce, plain, nil)
+
+	header := make([]byte, 0, headerSizeFlags)
+	header = append(header, encryptedMagic...)
+	header = append(header, encryptedVersionFlags, key.ID, flags)
+	header = append(header, nonce...)
+
+	mac := hmac.New(sha256.New, key.HashKey)
+	mac.Write(header)
+	mac.Write(ciphertext)
+	tag := mac.Sum(nil)
+
+	raw := make([]byte, 0, len(header)+len(ciphertext)+len(tag))
+	raw = append(raw, header...)
+	raw = append(raw, ciphertext...)
+	raw = append(raw, tag...)
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
+	base64.StdEncoding.Encode(encoded, raw)
+	return encoded, nil
+}
+
+// decryptFileHeader reverses encryptFileHeader. It uses the first of
+// keys whose ID matches the key ID in the file header, so that a file
+// written under an older key (before a rotation) still loads
+// correctly as long as that key is in keys; other keys sharing the
+// same ID are not tried. The HMAC tag is checked in constant time
+// before anything is decrypted.
+func decryptFileHeader(data []byte, keys []KeyPair) (fileHeader, error) {
+	plain, err := decryptBytes(data, keys)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	var fh fileHeader
+	if err := json.Unmarshal(plain, &fh); err != nil {
+		return fileHeader{}, errgo.Mask(err)
+	}
+	return fh, nil
+}
+
+// decryptBytes reverses encryptBytes; it's the shared primitive
+// behind decryptFileHeader and the journal's per-record decryption.
+// It understands both the original header layout (version 1, no
+// flags byte) and the current one (version 2, adds a flags byte for
+// compression), so files written before compression support existed
+// keep decrypting after an upgrade.
+func decryptBytes(data []byte, keys []KeyPair) ([]byte, error) {
+	raw := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(raw, bytes.TrimSpace(data))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decode cookie file")
+	}
+	raw = raw[:n]
+	if len(raw) < len(encryptedMagic)+2 {
+		return nil, errgo.New("cookie file too short")
+	}
+	if !bytes.HasPrefix(raw, []byte(encryptedMagic)) {
+		return nil, errgo.New("cookie file has wrong magic")
+	}
+	version := raw[len(encryptedMagic)]
+	var headerSize int
+	var flags byte
+	switch version {
+	case encryptedVersionPlain:
+		headerSize = headerSizePlain
+	case encryptedVersionFlags:
+		headerSize = headerSizeFlags
+	default:
+		return nil, errgo.Newf("cookie file has unknown version %d", version)
+	}
+	if len(raw) < headerSize+sha256.Size {
+		return nil, errgo.New("cookie file too short")
+	}
+	header := raw[:headerSize]
+	tag := raw[len(raw)-sha256.Size:]
+	ciphertext := raw[headerSize : len(raw)-sha256.Size]
+	keyID := header[len(encryptedMagic)+1]
+	var nonce []byte
+	if version == encryptedVersionFlags {
+		flags = header[len(encryptedMagic)+2]
+		nonce = header[len(encryptedMagic)+3:]
+	} else {
+		nonce = header[len(encryptedMagic)+2:]
+	}
+
+	key, ok := keyByID(keys, keyID)
+	if !ok {
+		return nil, errgo.Newf("cookie file encrypted with unknown key id %d", keyID)
+	}
+	mac := hmac.New(sha256.New, key.HashKey)
+	mac.Write(header)
+	mac.Write(ciphertext)
+	if !hmac.Equal(tag, mac.Sum(nil)) {
+		return nil, errgo.New("cookie file failed authentication")
+	}
+	block, err := aes.NewCipher(key.BlockKey)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid block key")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt cookie file")
+	}
+	if flags&flagCompressed != 0 {
+		plain, err = gzipDecompress(plain)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot decompress cookie file")
+		}
+	}
+	return plain, nil
+}
+
+// looksEncrypted reports whether data is plausibly an encrypted
+// cookie file rather than plain JSON.
+func looksEncrypted(data []byte) bool {
+	raw := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(raw, bytes.TrimSpace(data))
+	if err != nil || n < len(encryptedMagic) {
+		return false
+	}
+	return bytes.HasPrefix(raw[:n], []byte(encryptedMagic))
+}
+
+func gzipCompress(plain []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(compressed []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyPair(id byte) KeyPair {
+	return KeyPair{
+		ID:       id,
+		HashKey:  bytes32(id),
+		BlockKey: bytes32(id + 1),
+	}
+}
+
+func bytes32(b byte) []byte {
+	buf := make([]byte, 32)
+	for i := range buf {
+		buf[i] = b
+	}
+	return buf
+}
+
+func TestEncryptedSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cookies.enc")
+	key := testKeyPair(1)
+
+	jar, err := NewEncrypted(filename, []KeyPair{key}, nil)
+	if err != nil {
+		t.Fatalf("NewEncrypted: %v", err)
+	}
+	u := mustURL(t, "http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "abc", MaxAge: 3600}})
+	if err := jar.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("read saved file: %v", err)
+	}
+	if !looksEncrypted(raw) {
+		t.Fatalf("saved file doesn't look encrypted: %q", raw)
+	}
+
+	jar2, err := NewEncrypted(filename, []KeyPair{key}, nil)
+	if err != nil {
+		t.Fatalf("NewEncrypted (reload): %v", err)
+	}
+	got := jar2.Cookies(u)
+	if len(got) != 1 || got[0].Name != "session" || got[0].Value != "abc" {
+		t.Fatalf("unexpected cookies after reload: %v", got)
+	}
+
+	// The wrong key must fail to decrypt rather than silently
+	// returning garbage or an empty jar.
+	if _, err := NewEncrypted(filename, []KeyPair{testKeyPair(2)}, nil); err == nil {
+		t.Fatalf("NewEncrypted with wrong key: want error, got nil")
+	}
+}
+
+func TestJournalIsEncryptedForEncryptedJar(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cookies.enc")
+	key := testKeyPair(1)
+
+	jar, err := NewEncrypted(filename, []KeyPair{key}, nil)
+	if err != nil {
+		t.Fatalf("NewEncrypted: %v", err)
+	}
+	// Establish the cookie file first: replayJournal only runs for a
+	// load that finds an existing file, matching the plain (file,
+	// no storage) jar's crash-recovery behavior.
+	if err := jar.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	u := mustURL(t, "http://example.com/")
+	const secret = "super-secret-session-value"
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: secret, MaxAge: 3600}})
+
+	raw, err := os.ReadFile(jar.journalPath())
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	if bytes.Contains(raw, []byte(secret)) {
+		t.Fatalf("journal for an encrypted jar contains the cookie value in cleartext: %q", raw)
+	}
+	if !looksEncrypted(raw) {
+		t.Fatalf("journal for an encrypted jar doesn't look encrypted: %q", raw)
+	}
+
+	// A crash before Save must still be recoverable from the
+	// encrypted journal by a fresh jar using the same keys.
+	jar2, err := NewEncrypted(filename, []KeyPair{key}, nil)
+	if err != nil {
+		t.Fatalf("NewEncrypted (recover): %v", err)
+	}
+	got := jar2.Cookies(u)
+	if len(got) != 1 || got[0].Name != "session" || got[0].Value != secret {
+		t.Fatalf("unexpected cookies recovered from journal: %v", got)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cookies.enc")
+	oldKey := testKeyPair(1)
+	newKey := testKeyPair(3)
+
+	jar, err := NewEncrypted(filename, []KeyPair{oldKey}, nil)
+	if err != nil {
+		t.Fatalf("NewEncrypted: %v", err)
+	}
+	u := mustURL(t, "http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "abc", MaxAge: 3600}})
+	if err := jar.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if err := jar.RotateKeys([]KeyPair{newKey}); err != nil {
+		t.Fatalf("RotateKeys: %v", err)
+	}
+
+	// A jar that only knows the old key can no longer read the file.
+	if _, err := NewEncrypted(filename, []KeyPair{oldKey}, nil); err == nil {
+		t.Fatalf("NewEncrypted with rotated-away key: want error, got nil")
+	}
+
+	jar2, err := NewEncrypted(filename, []KeyPair{newKey}, nil)
+	if err != nil {
+		t.Fatalf("NewEncrypted with new key: %v", err)
+	}
+	got := jar2.Cookies(u)
+	if len(got) != 1 || got[0].Value != "abc" {
+		t.Fatalf("unexpected cookies after rotation: %v", got)
+	}
+}
+
+// encryptV1 reproduces the original (pre-compression) encrypted file
+// layout by hand: magic, version 1, key id, nonce, with no flags
+// byte. It exists only so TestDecryptsOldHeaderVersion can prove that
+// files written by that earlier format still decrypt.
+func encryptV1(t *testing.T, fh fileHeader, key KeyPair) []byte {
+	t.Helper()
+	plain, err := json.Marshal(fh)
+	if err != nil {
+		t.Fatalf("marshal fileHeader: %v", err)
+	}
+	block, err := aes.NewCipher(key.BlockKey)
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("cipher.NewGCM: %v", err)
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		t.Fatalf("read nonce: %v", err)
+	}
+	ciphertext := gcm.Seal(nil, nonce, plain, nil)
+
+	header := make([]byte, 0, headerSizePlain)
+	header = append(header, encryptedMagic...)
+	header = append(header, encryptedVersionPlain, key.ID)
+	header = append(header, nonce...)
+
+	mac := hmac.New(sha256.New, key.HashKey)
+	mac.Write(header)
+	mac.Write(ciphertext)
+	tag := mac.Sum(nil)
+
+	raw := append(append(header, ciphertext...), tag...)
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
+	base64.StdEncoding.Encode(encoded, raw)
+	return encoded
+}
+
+// TestDecryptsOldHeaderVersion is the regression test for the bug
+// where adding the flags byte for compression widened the header
+// without versioning it, so cookie files written by the previous
+// format (no flags byte) would fail authentication and become
+// unreadable after an upgrade.
+func TestDecryptsOldHeaderVersion(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cookies.enc")
+	key := testKeyPair(1)
+
+	fh := fileHeader{
+		Revision: 1,
+		Entries: []entry{{
+			Name: "session", Value: "abc", Domain: "example.com", Path: "/",
+			Persistent: true, HostOnly: true,
+		}},
+	}
+	if err := os.WriteFile(filename, encryptV1(t, fh, key), 0600); err != nil {
+		t.Fatalf("write old-format file: %v", err)
+	}
+
+	jar, err := NewEncrypted(filename, []KeyPair{key}, nil)
+	if err != nil {
+		t.Fatalf("NewEncrypted: %v", err)
+	}
+	got := jar.Cookies(mustURL(t, "http://example.com/"))
+	if len(got) != 1 || got[0].Name != "session" || got[0].Value != "abc" {
+		t.Fatalf("unexpected cookies read from old-format file: %v", got)
+	}
+}
+
+func TestEncryptedCompressedSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cookies.enc")
+	key := testKeyPair(1)
+
+	jar, err := NewEncrypted(filename, []KeyPair{key}, &EncryptOptions{Compress: true})
+	if err != nil {
+		t.Fatalf("NewEncrypted: %v", err)
+	}
+	u := mustURL(t, "http://example.com/")
+	// A long, repetitive value so a compressed file is smaller than an
+	// uncompressed one; that's the whole point of the option.
+	value := strings.Repeat("abcdefghij", 200)
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: value, MaxAge: 3600}})
+	if err := jar.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	compressed, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("read saved file: %v", err)
+	}
+	if !looksEncrypted(compressed) {
+		t.Fatalf("saved file doesn't look encrypted: %q", compressed)
+	}
+
+	jar2, err := NewEncrypted(filename, []KeyPair{key}, &EncryptOptions{Compress: true})
+	if err != nil {
+		t.Fatalf("NewEncrypted (reload): %v", err)
+	}
+	got := jar2.Cookies(u)
+	if len(got) != 1 || got[0].Name != "session" || got[0].Value != value {
+		t.Fatalf("unexpected cookies after reload: %v", got)
+	}
+
+	uncompressedJar, err := NewEncrypted(filepath.Join(dir, "cookies-plain.enc"), []KeyPair{key}, nil)
+	if err != nil {
+		t.Fatalf("NewEncrypted (uncompressed): %v", err)
+	}
+	uncompressedJar.SetCookies(u, []*http.Cookie{{Name: "session", Value: value, MaxAge: 3600}})
+	if err := uncompressedJar.Save(); err != nil {
+		t.Fatalf("Save (uncompressed): %v", err)
+	}
+	uncompressed, err := os.ReadFile(uncompressedJar.filename)
+	if err != nil {
+		t.Fatalf("read uncompressed file: %v", err)
+	}
+	if len(compressed) >= len(uncompressed) {
+		t.Fatalf("compressed file (%d bytes) is not smaller than uncompressed (%d bytes)", len(compressed), len(uncompressed))
+	}
+}
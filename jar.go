@@ -0,0 +1,418 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cookiejar implements an in-memory RFC 6265-compliant
+// http.CookieJar, with optional persistence of its cookies to disk
+// (or any other Storage backend) between runs.
+package cookiejar
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// PublicSuffixList provides the public suffix of a domain. For
+// example:
+//   - the public suffix of "example.com" is "com",
+//   - the public suffix of "foo1.foo2.foo3.co.uk" is "co.uk", and
+//   - the public suffix of "bar.pvt.k12.ma.us" is "pvt.k12.ma.us".
+//
+// A nil PublicSuffixList is treated as one that always returns "":
+// no domain counts as a public suffix, so a cookie's domain attribute
+// is accepted whenever it is a suffix of the host, even one such as
+// "co.uk". golang.org/x/net/publicsuffix provides a real list.
+type PublicSuffixList interface {
+	PublicSuffix(domain string) string
+	String() string
+}
+
+// Options are the options for creating a new Jar.
+type Options struct {
+	// PublicSuffixList, if non-nil, is used to judge whether a
+	// cookie's domain attribute is valid, and whether a cookie with
+	// Domain set can be sent to subdomains of that domain.
+	PublicSuffixList PublicSuffixList
+
+	// Filename is the path to the persistent cookie file. It's
+	// required unless Storage is set.
+	Filename string
+
+	// Storage, if non-nil, is used for persistence instead of the
+	// built-in file+lock behaviour; see the Storage type.
+	Storage Storage
+
+	// LockTimeout bounds how long Save/load wait for the advisory
+	// file lock (when Storage is nil) before giving up. Defaults to
+	// defaultLockTimeout if zero.
+	LockTimeout time.Duration
+}
+
+// Jar implements http.CookieJar, with its cookies optionally
+// persisted to disk (or another Storage backend) between runs.
+type Jar struct {
+	psList PublicSuffixList
+
+	filename    string
+	storage     Storage
+	lockTimeout time.Duration
+
+	// keys, if non-empty, makes Save/load encrypt/decrypt the
+	// cookie file; see NewEncrypted.
+	keys []KeyPair
+
+	// compress gzip-compresses the plaintext before encrypting it
+	// (and decompresses after decrypting); only meaningful alongside
+	// keys. See EncryptOptions.
+	compress bool
+
+	// autoSave is non-nil once StartAutoSave has been called.
+	autoSave *AutoSaver
+
+	mu sync.Mutex
+
+	// entries is keyed by canonical host, then by the cookie's own
+	// id (name;domain;path), mirroring the RFC 6265 "cookie store".
+	entries map[string]map[string]entry
+
+	// lastRevision is the file revision this Jar last observed on
+	// disk, via either load or save; see revision.go.
+	lastRevision uint64
+
+	// dirty tracks entries set or refreshed since the last
+	// successful Save, keyed the same way as the journal; see
+	// revision.go and journal.go.
+	dirty map[string]entry
+}
+
+// New returns a new cookie jar. A nil *Options is equivalent to a
+// zero Options.
+func New(o *Options) (*Jar, error) {
+	jar := newJar(o)
+	if jar.filename == "" && jar.storage == nil {
+		return jar, nil
+	}
+	if err := jar.load(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return jar, nil
+}
+
+// newJar builds the zero-value Jar described by o, without loading
+// it. It's factored out of New so that NewEncrypted can set j.keys
+// before the initial load, rather than after: loading before keys
+// are known would try (and fail) to parse an encrypted file as plain
+// JSON.
+func newJar(o *Options) *Jar {
+	jar := &Jar{
+		entries: make(map[string]map[string]entry),
+	}
+	if o != nil {
+		jar.psList = o.PublicSuffixList
+		jar.filename = o.Filename
+		jar.storage = o.Storage
+		jar.lockTimeout = o.LockTimeout
+	}
+	return jar
+}
+
+// entry is the internal representation of a cookie.
+//
+// This struct type is not used outside of this package per se, but
+// the exported fields are those of RFC 6265.
+type entry struct {
+	Name       string
+	Value      string
+	Domain     string
+	Path       string
+	Secure     bool
+	HttpOnly   bool
+	Persistent bool
+	HostOnly   bool
+	Expires    time.Time
+	Creation   time.Time
+	LastAccess time.Time
+
+	// Updated is the last time this entry was set or refreshed by
+	// SetCookies, as opposed to merely read by Cookies (which only
+	// bumps LastAccess). It's what dirty-tracking and merges key
+	// their last-write-wins comparisons on; see revision.go.
+	Updated time.Time
+
+	seqNum uint64
+}
+
+// id returns the entry's identity within its host's submap: cookies
+// are unique per (name, domain, path), matching RFC 6265 section 5.3.
+func (e entry) id() string {
+	return e.Name + ";" + e.Domain + ";" + e.Path
+}
+
+var seqNum uint64
+
+func nextSeqNum() uint64 {
+	seqNum++
+	return seqNum
+}
+
+// canonicalHost strips any port and lower-cases host, returning the
+// form cookies are keyed on.
+func canonicalHost(host string) (string, error) {
+	host = strings.TrimSuffix(host, ".")
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && strings.LastIndexByte(host, ']') < i {
+		host = host[:i]
+	}
+	return strings.ToLower(host), nil
+}
+
+func hasDotSuffix(s, suffix string) bool {
+	return len(s) > len(suffix) && s[len(s)-len(suffix)-1] == '.' && s[len(s)-len(suffix):] == suffix
+}
+
+// domainAndType decides the effective domain and whether a cookie
+// with the given explicit domain attribute (empty if none) set while
+// visiting host is a host-only cookie.
+func (j *Jar) domainAndType(host, domain string) (string, bool, error) {
+	if domain == "" {
+		return host, true, nil
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" || strings.Contains(domain, "..") {
+		return "", false, errgo.Newf("invalid cookie domain %q", domain)
+	}
+	domain = strings.TrimPrefix(domain, ".")
+	if host != domain && !hasDotSuffix(host, domain) {
+		return "", false, errgo.Newf("cookie domain %q is not a suffix of host %q", domain, host)
+	}
+	if j.psList != nil {
+		if ps := j.psList.PublicSuffix(domain); ps == domain {
+			return "", false, errgo.Newf("cookie domain %q is a public suffix", domain)
+		}
+	}
+	return domain, false, nil
+}
+
+// defaultPath computes the default-path of a URL per RFC 6265 §5.1.4.
+func defaultPath(urlPath string) string {
+	if urlPath == "" || urlPath[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndexByte(urlPath, '/')
+	if i == 0 {
+		return "/"
+	}
+	return urlPath[:i]
+}
+
+// newEntry builds the entry for c as observed on a URL with the given
+// host and path, and reports whether the resulting cookie should be
+// removed (MaxAge<0, or an Expires time already in the past) rather
+// than stored.
+func (j *Jar) newEntry(c *http.Cookie, now time.Time, host, urlPath string) (e entry, remove bool, err error) {
+	domain, hostOnly, err := j.domainAndType(host, c.Domain)
+	if err != nil {
+		return entry{}, false, err
+	}
+	path := c.Path
+	if path == "" {
+		path = defaultPath(urlPath)
+	}
+	e = entry{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   domain,
+		Path:     path,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		HostOnly: hostOnly,
+		Creation: now,
+		seqNum:   nextSeqNum(),
+	}
+	switch {
+	case c.MaxAge < 0:
+		return e, true, nil
+	case c.MaxAge > 0:
+		e.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		e.Persistent = true
+	case !c.Expires.IsZero():
+		if c.Expires.Before(now) {
+			return e, true, nil
+		}
+		e.Expires = c.Expires
+		e.Persistent = true
+	default:
+		e.Persistent = false
+	}
+	return e, false, nil
+}
+
+// SetCookies implements the http.CookieJar interface, storing
+// cookies as observed while visiting u.
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host, err := canonicalHost(u.Host)
+	if err != nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, c := range cookies {
+		e, remove, err := j.newEntry(c, now, host, u.Path)
+		if err != nil {
+			continue
+		}
+		submap := j.entries[e.Domain]
+		id := e.id()
+		if remove {
+			if submap != nil {
+				if _, ok := submap[id]; ok {
+					delete(submap, id)
+					j.noteDeleted(entryID(e))
+				}
+			}
+			continue
+		}
+		if submap == nil {
+			submap = make(map[string]entry)
+			j.entries[e.Domain] = submap
+		}
+		if old, ok := submap[id]; ok {
+			e.Creation = old.Creation
+			e.seqNum = old.seqNum
+		}
+		e.LastAccess = now
+		e.Updated = now
+		submap[id] = e
+		j.noteDirty(e)
+	}
+}
+
+// Cookies implements the http.CookieJar interface, returning the
+// cookies that should be sent when visiting u.
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	host, err := canonicalHost(u.Host)
+	if err != nil {
+		return nil
+	}
+	secure := u.Scheme == "https"
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	var selected []entry
+	for domain, submap := range j.entries {
+		if domain != host && !hasDotSuffix(host, domain) {
+			continue
+		}
+		for id, e := range submap {
+			if e.Persistent && !e.Expires.IsZero() && !e.Expires.After(now) {
+				delete(submap, id)
+				j.noteDeleted(entryID(e))
+				continue
+			}
+			if e.HostOnly && domain != host {
+				continue
+			}
+			if e.Secure && !secure {
+				continue
+			}
+			if !pathMatch(u.Path, e.Path) {
+				continue
+			}
+			e.LastAccess = now
+			submap[id] = e
+			selected = append(selected, e)
+		}
+	}
+	sortCookies(selected)
+	cookies := make([]*http.Cookie, len(selected))
+	for i, e := range selected {
+		cookies[i] = &http.Cookie{Name: e.Name, Value: e.Value}
+	}
+	return cookies
+}
+
+func pathMatch(requestPath, cookiePath string) bool {
+	if requestPath == cookiePath {
+		return true
+	}
+	if strings.HasPrefix(requestPath, cookiePath) {
+		if cookiePath[len(cookiePath)-1] == '/' {
+			return true
+		} else if requestPath[len(cookiePath)] == '/' {
+			return true
+		}
+	}
+	return false
+}
+
+func sortCookies(entries []entry) {
+	sort.Slice(entries, func(i, k int) bool {
+		if len(entries[i].Path) != len(entries[k].Path) {
+			return len(entries[i].Path) > len(entries[k].Path)
+		}
+		if !entries[i].Creation.Equal(entries[k].Creation) {
+			return entries[i].Creation.Before(entries[k].Creation)
+		}
+		return entries[i].seqNum < entries[k].seqNum
+	})
+}
+
+// merge inserts entries into j, overwriting any existing entry with
+// the same id. Unlike SetCookies, merge doesn't mark entries dirty
+// or journal them: it's used to bring in state that's already
+// durable elsewhere (the cookie file, the journal, a Storage
+// backend), not to record a new local mutation.
+func (j *Jar) merge(entries []entry) {
+	for _, e := range entries {
+		if e.Domain == "" {
+			continue
+		}
+		submap := j.entries[e.Domain]
+		if submap == nil {
+			submap = make(map[string]entry)
+			j.entries[e.Domain] = submap
+		}
+		if e.seqNum == 0 {
+			e.seqNum = nextSeqNum()
+		}
+		submap[e.id()] = e
+	}
+}
+
+// deleteExpired removes every persistent entry whose Expires time
+// has passed, journaling each removal via noteDeleted.
+func (j *Jar) deleteExpired(now time.Time) {
+	for _, submap := range j.entries {
+		for id, e := range submap {
+			if e.Persistent && !e.Expires.IsZero() && !e.Expires.After(now) {
+				delete(submap, id)
+				j.noteDeleted(entryID(e))
+			}
+		}
+	}
+}
+
+// byCanonicalHost sorts entries primarily by canonical host name and
+// secondarily by path length, matching the historical on-disk order.
+type byCanonicalHost struct {
+	entries []entry
+}
+
+func (s byCanonicalHost) Len() int { return len(s.entries) }
+func (s byCanonicalHost) Swap(i, k int) {
+	s.entries[i], s.entries[k] = s.entries[k], s.entries[i]
+}
+func (s byCanonicalHost) Less(i, k int) bool {
+	e1, e2 := s.entries[i], s.entries[k]
+	if e1.Domain != e2.Domain {
+		return e1.Domain < e2.Domain
+	}
+	return len(e1.Path) < len(e2.Path)
+}
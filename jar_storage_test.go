@@ -0,0 +1,50 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	cookiejar "github.com/caeret/persistent-cookiejar"
+	"github.com/caeret/persistent-cookiejar/storage/memory"
+)
+
+// TestStorageSaveLoadRoundTrip is the regression test for the bug
+// where saveWithStorage merged the freshly-loaded storage contents
+// over j.entries unconditionally, reverting any local SetCookies
+// update to a pre-existing cookie on the very next Save, even with no
+// concurrency involved.
+func TestStorageSaveLoadRoundTrip(t *testing.T) {
+	u, err := url.Parse("http://example.com/")
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	store := &memory.Storage{}
+
+	jar, err := cookiejar.New(&cookiejar.Options{Storage: store})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "v1", MaxAge: 3600}})
+	if err := jar.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "v2", MaxAge: 3600}})
+	if err := jar.Save(); err != nil {
+		t.Fatalf("second Save: %v", err)
+	}
+
+	jar2, err := cookiejar.New(&cookiejar.Options{Storage: store})
+	if err != nil {
+		t.Fatalf("New (reload): %v", err)
+	}
+	got := jar2.Cookies(u)
+	if len(got) != 1 || got[0].Name != "a" || got[0].Value != "v2" {
+		t.Fatalf("unexpected cookies after reload: %v, want a=v2", got)
+	}
+}
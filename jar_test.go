@@ -0,0 +1,76 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func mustURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("cannot parse %q: %v", s, err)
+	}
+	return u
+}
+
+func TestSetCookiesAndCookies(t *testing.T) {
+	jar, err := New(nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	u := mustURL(t, "http://example.com/foo")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1"},
+		{Name: "b", Value: "2", MaxAge: 3600},
+	})
+	got := jar.Cookies(u)
+	if len(got) != 2 {
+		t.Fatalf("got %d cookies, want 2: %v", len(got), got)
+	}
+	values := map[string]string{}
+	for _, c := range got {
+		values[c.Name] = c.Value
+	}
+	if values["a"] != "1" || values["b"] != "2" {
+		t.Fatalf("unexpected cookie values: %v", values)
+	}
+
+	// A different host shouldn't see the cookies.
+	other := jar.Cookies(mustURL(t, "http://other.example/"))
+	if len(other) != 0 {
+		t.Fatalf("unexpected cookies for other host: %v", other)
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cookies.json")
+
+	jar, err := New(&Options{Filename: filename})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	u := mustURL(t, "http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "session", Value: "abc", MaxAge: 3600},
+	})
+	if err := jar.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	jar2, err := New(&Options{Filename: filename})
+	if err != nil {
+		t.Fatalf("New (reload): %v", err)
+	}
+	got := jar2.Cookies(u)
+	if len(got) != 1 || got[0].Name != "session" || got[0].Value != "abc" {
+		t.Fatalf("unexpected cookies after reload: %v", got)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// journalRecord is one entry in the "<filename>.journal" file: a
+// compact record of a single mutation made since the last successful
+// Save, so that a crash between two Save calls doesn't lose cookies
+// set in between.
+type journalRecord struct {
+	Op    string    `json:"op"` // "set" or "del"
+	ID    string    `json:"id"`
+	Entry *entry    `json:"entry,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+func (j *Jar) journalPath() string {
+	return j.filename + ".journal"
+}
+
+// appendJournal appends rec to the journal file, one line per record.
+// If j.keys is set (a jar created via NewEncrypted), the line is
+// encrypted the same way the cookie file itself is; otherwise the
+// line is plain JSON. Failures are logged rather than returned,
+// matching the "best effort, don't break the caller's mutation"
+// treatment the rest of the dirty tracking gets: a missing journal
+// entry only matters if the process also crashes before the next
+// Save.
+func (j *Jar) appendJournal(rec journalRecord) {
+	if j.filename == "" {
+		return
+	}
+	rec.Time = time.Now()
+	plain, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("cannot encode cookie journal record: %v", err)
+		return
+	}
+	line := plain
+	if len(j.keys) > 0 {
+		line, err = encryptBytes(plain, j.keys, j.compress)
+		if err != nil {
+			log.Printf("cannot encrypt cookie journal record: %v", err)
+			return
+		}
+	}
+	f, err := os.OpenFile(j.journalPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("cannot open cookie journal: %v", err)
+		return
+	}
+	defer f.Close()
+	line = append(line, '\n')
+	if _, err := f.Write(line); err != nil {
+		log.Printf("cannot append to cookie journal: %v", err)
+	}
+}
+
+// replayJournal applies any records left over from a previous
+// process that mutated j's cookies but crashed before its next Save
+// could persist them (and truncate the journal).
+func (j *Jar) replayJournal() error {
+	f, err := os.Open(j.journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+
+	var entries []entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		plain := line
+		if len(j.keys) > 0 && looksEncrypted(line) {
+			plain, err = decryptBytes(line, j.keys)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(plain, &rec); err != nil {
+			return errgo.Mask(err)
+		}
+		if rec.Op == "set" && rec.Entry != nil {
+			entries = append(entries, *rec.Entry)
+		}
+		// "del" records need no replay: deleteExpired will remove
+		// the entry again on the next save if it's still expired,
+		// and a live replacement cookie will already be the most
+		// recent "set" record for the same id.
+	}
+	if err := scanner.Err(); err != nil {
+		return errgo.Mask(err)
+	}
+	j.merge(entries)
+	return nil
+}
+
+// truncateJournal discards the journal after a successful Save,
+// since every mutation it recorded is now durable in the cookie file
+// itself.
+func (j *Jar) truncateJournal() error {
+	err := os.Remove(j.journalPath())
+	if err != nil && !os.IsNotExist(err) {
+		return errgo.Mask(err)
+	}
+	return nil
+}
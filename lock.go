@@ -0,0 +1,83 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// defaultLockTimeout is used when a Jar or FileStorage doesn't
+// configure its own LockTimeout.
+const defaultLockTimeout = 2 * time.Second
+
+const lockRetryDelay = 100 * time.Microsecond
+
+// lockFileTimeout acquires an advisory, cross-process exclusive lock
+// guarding path, retrying for up to timeout before giving up, with ctx's
+// cancellation aborting the wait early. It replaces the previous
+// github.com/juju/mutex (and the github.com/juju/utils/clock it
+// dragged in) with OS-native advisory locking, implemented
+// per-platform in lock_unix.go and lock_windows.go: flock on Unix,
+// LockFileEx on Windows. The lock is taken on a sidecar "<path>.lock"
+// file rather than path itself, so the cookie file's own contents are
+// untouched by locking.
+//
+// The retry semantics match the previous implementation: an initial
+// 100µs delay between attempts, up to timeout total, with a
+// guaranteed final attempt right at the deadline.
+func lockFileTimeout(ctx context.Context, path string, timeout time.Duration) (io.Closer, error) {
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	retry := lockRetryDelay
+	start := time.Now()
+	for {
+		if err := lockFileHandle(f); err == nil {
+			return &fileLock{f}, nil
+		}
+		if err := ctx.Err(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		total := time.Since(start)
+		if total > timeout {
+			f.Close()
+			return nil, errgo.Newf("file locked for too long; giving up")
+		}
+		// Always have at least one try at the end of the interval.
+		if remain := timeout - total; retry > remain {
+			retry = remain
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+// fileLock is the io.Closer returned by lockFileTimeout; closing it releases
+// the underlying advisory lock and closes the sidecar file.
+type fileLock struct {
+	f *os.File
+}
+
+func (l *fileLock) Close() error {
+	err := unlockFileHandle(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFileTimeoutSameProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+
+	lock, err := lockFileTimeout(context.Background(), path, time.Second)
+	if err != nil {
+		t.Fatalf("lockFileTimeout: %v", err)
+	}
+
+	// A second, overlapping attempt on the same path must time out
+	// rather than acquiring the lock the first attempt still holds.
+	_, err = lockFileTimeout(context.Background(), path, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("second lockFileTimeout: want timeout error, got nil")
+	}
+
+	if err := lock.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Once released, a fresh attempt must succeed.
+	lock2, err := lockFileTimeout(context.Background(), path, time.Second)
+	if err != nil {
+		t.Fatalf("lockFileTimeout after release: %v", err)
+	}
+	if err := lock2.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestLockFileTimeoutContextCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+
+	lock, err := lockFileTimeout(context.Background(), path, time.Second)
+	if err != nil {
+		t.Fatalf("lockFileTimeout: %v", err)
+	}
+	defer lock.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := lockFileTimeout(ctx, path, time.Second); err == nil {
+		t.Fatalf("lockFileTimeout with cancelled context: want error, got nil")
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package cookiejar
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFileHandle tries to take an exclusive, non-blocking flock on
+// f, returning an error immediately if it's already held elsewhere.
+func lockFileHandle(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// unlockFileHandle releases a lock taken by lockFileHandle.
+func unlockFileHandle(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+const netscapeHeader = "# Netscape HTTP Cookie File"
+
+const httpOnlyPrefix = "#HttpOnly_"
+
+// NetscapeOptions controls ExportNetscape's behaviour.
+type NetscapeOptions struct {
+	// IncludeSession, if true, also exports cookies that don't
+	// persist across restarts (normally skipped, since a
+	// cookies.txt file outlives the process and a session cookie
+	// written to it would outlive its session).
+	IncludeSession bool
+}
+
+// ExportNetscape writes j's cookies to w in the classic Netscape
+// "cookies.txt" format understood by curl, wget and most browsers.
+// Session cookies are skipped unless opts.IncludeSession is true;
+// opts may be nil, which is equivalent to a zero NetscapeOptions.
+func (j *Jar) ExportNetscape(w io.Writer, opts *NetscapeOptions) error {
+	if opts == nil {
+		opts = &NetscapeOptions{}
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(netscapeHeader + "\n\n"); err != nil {
+		return errgo.Mask(err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, submap := range j.entries {
+		for _, e := range submap {
+			if !e.Persistent && !opts.IncludeSession {
+				continue
+			}
+			if err := writeNetscapeLine(bw, e); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	return errgo.Mask(bw.Flush())
+}
+
+func writeNetscapeLine(w io.Writer, e entry) error {
+	domain := e.Domain
+	if !e.HostOnly && !strings.HasPrefix(domain, ".") {
+		domain = "." + domain
+	}
+	if e.HttpOnly {
+		domain = httpOnlyPrefix + domain
+	}
+	var expires int64
+	if !e.Expires.IsZero() {
+		expires = e.Expires.Unix()
+	}
+	fields := []string{
+		domain,
+		boolField(!e.HostOnly),
+		e.Path,
+		boolField(e.Secure),
+		strconv.FormatInt(expires, 10),
+		e.Name,
+		e.Value,
+	}
+	_, err := io.WriteString(w, strings.Join(fields, "\t")+"\n")
+	return err
+}
+
+func boolField(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+// ImportNetscape reads cookies in the Netscape "cookies.txt" format
+// from r and adds them to j, as if they'd been set by SetCookies.
+// Blank lines and lines starting with "#" (other than the
+// "#HttpOnly_" domain prefix) are ignored, matching the format's
+// historical tolerance for comments.
+func (j *Jar) ImportNetscape(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var entries []entry
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		httpOnly := false
+		if strings.HasPrefix(line, httpOnlyPrefix) {
+			httpOnly = true
+			line = line[len(httpOnlyPrefix):]
+		} else if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		domain := fields[0]
+		hostOnly := fields[1] != "TRUE"
+		if !hostOnly {
+			domain = strings.TrimPrefix(domain, ".")
+		}
+		expiresSecs, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return errgo.Notef(err, "invalid expiration %q", fields[4])
+		}
+		var expires time.Time
+		if expiresSecs != 0 {
+			expires = time.Unix(expiresSecs, 0)
+		}
+		entries = append(entries, entry{
+			Name:       fields[5],
+			Value:      fields[6],
+			Domain:     domain,
+			Path:       fields[2],
+			Secure:     fields[3] == "TRUE",
+			HttpOnly:   httpOnly,
+			Persistent: !expires.IsZero(),
+			HostOnly:   hostOnly,
+			Expires:    expires,
+			Creation:   time.Now(),
+			LastAccess: time.Now(),
+			Updated:    time.Now(),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return errgo.Mask(err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.merge(entries)
+	// Imported entries are new local mutations, not state recovered
+	// from somewhere already durable, so (unlike merge's usual
+	// callers) they need the same dirty-tracking, journaling, and
+	// autosave-wakeup treatment SetCookies gives every other write;
+	// otherwise a running autosave loop won't persist them until its
+	// next timer tick.
+	for _, e := range entries {
+		j.noteDirty(e)
+	}
+	return nil
+}
+
+// LoadNetscape is a convenience wrapper that opens path and calls
+// ImportNetscape on it.
+func (j *Jar) LoadNetscape(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	return j.ImportNetscape(f)
+}
+
+// SaveNetscape is a convenience wrapper that creates (or truncates)
+// path and calls ExportNetscape on it.
+func (j *Jar) SaveNetscape(path string, opts *NetscapeOptions) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	return j.ExportNetscape(f, opts)
+}
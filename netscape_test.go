@@ -0,0 +1,106 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportNetscapeSkipsSessionCookiesByDefault(t *testing.T) {
+	jar, err := New(nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	u := mustURL(t, "http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "persistent", Value: "1", MaxAge: 3600},
+		{Name: "session", Value: "2"},
+	})
+
+	var buf bytes.Buffer
+	if err := jar.ExportNetscape(&buf, nil); err != nil {
+		t.Fatalf("ExportNetscape: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "persistent") {
+		t.Fatalf("export missing persistent cookie: %q", out)
+	}
+	if strings.Contains(out, "session") {
+		t.Fatalf("export included session cookie without IncludeSession: %q", out)
+	}
+
+	buf.Reset()
+	if err := jar.ExportNetscape(&buf, &NetscapeOptions{IncludeSession: true}); err != nil {
+		t.Fatalf("ExportNetscape: %v", err)
+	}
+	if !strings.Contains(buf.String(), "session") {
+		t.Fatalf("export with IncludeSession missing session cookie: %q", buf.String())
+	}
+}
+
+func TestImportExportNetscapeRoundTrip(t *testing.T) {
+	jar, err := New(nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	u := mustURL(t, "http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1", MaxAge: 3600, Secure: true, HttpOnly: true}})
+
+	var buf bytes.Buffer
+	if err := jar.ExportNetscape(&buf, nil); err != nil {
+		t.Fatalf("ExportNetscape: %v", err)
+	}
+
+	jar2, err := New(nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := jar2.ImportNetscape(&buf); err != nil {
+		t.Fatalf("ImportNetscape: %v", err)
+	}
+
+	got := jar2.Cookies(mustURL(t, "https://example.com/"))
+	if len(got) != 1 || got[0].Name != "a" || got[0].Value != "1" {
+		t.Fatalf("unexpected cookies after import: %v", got)
+	}
+
+	// The cookie was Secure, so it shouldn't be sent over plain HTTP.
+	if got := jar2.Cookies(u); len(got) != 0 {
+		t.Fatalf("secure cookie sent over plain http: %v", got)
+	}
+}
+
+// TestImportNetscapeJournalsEntries is the regression test for the
+// bug where ImportNetscape merged entries directly, bypassing
+// noteDirty: a jar with StartAutoSave running wouldn't persist
+// imported cookies until the next MaxInterval tick, unlike every
+// other mutation path.
+func TestImportNetscapeJournalsEntries(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cookies.json")
+
+	jar, err := New(&Options{Filename: filename})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const exported = "example.com\tFALSE\t/\tFALSE\t0\ta\t1\n"
+	if err := jar.ImportNetscape(strings.NewReader(exported)); err != nil {
+		t.Fatalf("ImportNetscape: %v", err)
+	}
+
+	raw, err := os.ReadFile(jar.journalPath())
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	if !strings.Contains(string(raw), "\"Name\":\"a\"") {
+		t.Fatalf("journal missing imported entry: %q", raw)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"encoding/json"
+	"io"
+
+	"gopkg.in/errgo.v1"
+)
+
+// fileHeader is the on-disk shape of a cookie file: the entries
+// alongside a monotonically increasing revision. Comparing the
+// revision we last observed against the one currently on disk lets
+// save tell whether another process has written the file since we
+// last read it, without a full entry-by-entry diff (replacing the
+// "optimization" TODO that used to sit in save). Files written
+// before this feature existed are a bare JSON array rather than this
+// struct; decodeFileHeader falls back to reading those as revision
+// 0.
+type fileHeader struct {
+	Revision uint64  `json:"revision"`
+	Entries  []entry `json:"entries"`
+}
+
+func decodeFileHeader(raw []byte) (fileHeader, error) {
+	var fh fileHeader
+	if err := json.Unmarshal(raw, &fh); err == nil {
+		return fh, nil
+	}
+	var entries []entry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fileHeader{}, err
+	}
+	return fileHeader{Entries: entries}, nil
+}
+
+func encodeFileHeader(w io.Writer, fh fileHeader) error {
+	return json.NewEncoder(w).Encode(fh)
+}
+
+// entryID identifies an entry for dirty-tracking and journal
+// purposes, independent of its value.
+func entryID(e entry) string {
+	return e.Domain + "\x00" + e.Path + "\x00" + e.Name
+}
+
+// noteDirty records that e was set or refreshed since the last
+// successful Save, so that a concurrent save from another process
+// can't silently clobber it with an older copy of the same cookie.
+// It's called alongside the existing entry-mutating paths (notably
+// the merge that SetCookies performs into j.entries).
+func (j *Jar) noteDirty(e entry) {
+	if j.dirty == nil {
+		j.dirty = make(map[string]entry)
+	}
+	j.dirty[entryID(e)] = e
+	j.appendJournal(journalRecord{Op: "set", ID: entryID(e), Entry: &e})
+	if j.autoSave != nil {
+		j.autoSave.signalDirty()
+	}
+}
+
+// noteDeleted is noteDirty's counterpart for entries removed (e.g.
+// expired, or replaced by a cookie with an earlier MaxAge=0) since
+// the last successful Save.
+func (j *Jar) noteDeleted(id string) {
+	delete(j.dirty, id)
+	j.appendJournal(journalRecord{Op: "del", ID: id})
+	if j.autoSave != nil {
+		j.autoSave.signalDirty()
+	}
+}
+
+// mergeFromFile reads a fileHeader from r (encrypted or plain,
+// matching writeToFile) and merges it into j, returning the
+// revision it read. If that revision is non-zero and the same one j
+// last saved or loaded, the merge is skipped entirely: nothing else can have
+// written the file, so j's in-memory state already reflects it.
+// Otherwise, entries are merged with last-write-wins semantics keyed
+// on (domain, path, name, Updated) against j's own dirty set, so a
+// concurrent writer's older copy of a cookie this process just set
+// doesn't win. Updated, not LastAccess, is what decides this: merely
+// reading a cookie via Cookies bumps LastAccess without making it any
+// more authoritative than a genuinely older write.
+func (j *Jar) mergeFromFile(r io.Reader) (uint64, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return j.lastRevision, errgo.Mask(err)
+	}
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	var fh fileHeader
+	if len(j.keys) > 0 && looksEncrypted(raw) {
+		fh, err = decryptFileHeader(raw, j.keys)
+	} else {
+		fh, err = decodeFileHeader(raw)
+	}
+	if err != nil {
+		return j.lastRevision, err
+	}
+	if fh.Revision != 0 && fh.Revision == j.lastRevision {
+		return fh.Revision, nil
+	}
+	j.mergeDirty(fh.Entries)
+	return fh.Revision, nil
+}
+
+// mergeDirty is like merge but skips any entry that j's own dirty
+// set has a copy of at least as new (by Updated, not LastAccess), so
+// a save racing with another process can't step on a cookie this
+// process just set, and a cookie this process has merely read can't
+// falsely outrank a genuinely newer write from elsewhere.
+func (j *Jar) mergeDirty(entries []entry) {
+	toMerge := entries[:0:0]
+	for _, e := range entries {
+		if local, ok := j.dirty[entryID(e)]; ok && !e.Updated.After(local.Updated) {
+			continue
+		}
+		toMerge = append(toMerge, e)
+	}
+	j.merge(toMerge)
+}
+
+// writeToFile writes j's entries to w as the next revision, in
+// whichever of the plain or encrypted fileHeader formats j is
+// configured for (see NewEncrypted).
+func (j *Jar) writeToFile(w io.Writer) error {
+	entries := j.allPersistentEntries()
+	j.lastRevision++
+	fh := fileHeader{Revision: j.lastRevision, Entries: entries}
+	if len(j.keys) > 0 {
+		data, err := encryptFileHeader(fh, j.keys, j.compress)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	return encodeFileHeader(w, fh)
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestMergeDirtyKeysOnUpdatedNotLastAccess is the regression test for
+// the bug where mergeDirty compared LastAccess instead of Updated.
+// LastAccess is bumped by mere reads (Cookies), so a stale entry
+// loaded from disk that was only ever read many times after being
+// written could out-rank a genuinely newer local write that hasn't
+// been saved yet, if the comparison used LastAccess instead of
+// Updated.
+func TestMergeDirtyKeysOnUpdatedNotLastAccess(t *testing.T) {
+	jar, err := New(nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	u := mustURL(t, "http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "newer-local-write"}})
+
+	local := jar.dirty[entryID(jar.entries["example.com"]["a;example.com;/"])]
+
+	// A stale entry loaded from disk: never rewritten since before
+	// our local write (older Updated), but read many times since,
+	// leaving LastAccess far ahead of both its own Updated and our
+	// local write's Updated.
+	stale := local
+	stale.Value = "stale-but-much-read"
+	stale.Updated = local.Updated.Add(-time.Hour)
+	stale.LastAccess = local.Updated.Add(time.Hour)
+
+	jar.mergeDirty([]entry{stale})
+
+	got := jar.entries["example.com"]["a;example.com;/"]
+	if got.Value != "newer-local-write" {
+		t.Fatalf("mergeDirty let a merely-read stale entry clobber a newer local write: got value %q", got.Value)
+	}
+}
@@ -5,20 +5,12 @@
 package cookiejar
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
+	"context"
 	"log"
 	"os"
-	"regexp"
 	"sort"
 	"time"
 
-	"github.com/juju/mutex"
-	"github.com/juju/utils/clock"
 	"gopkg.in/errgo.v1"
 )
 
@@ -31,25 +23,28 @@ func (j *Jar) Save() error {
 
 // save is like Save but takes the current time as a parameter.
 func (j *Jar) save(now time.Time) error {
-	releaser, err := lockFile(j.filename)
+	if j.storage != nil {
+		return j.saveWithStorage(now, j.storage)
+	}
+	unlock, err := lockFileTimeout(context.Background(), j.filename, j.lockTimeout)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	defer releaser.Release()
+	defer unlock.Close()
 	f, err := os.OpenFile(j.filename, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return errgo.Mask(err)
 	}
 	defer f.Close()
-	// TODO optimization: if the file hasn't changed since we
-	// loaded it, don't bother with the merge step.
 
 	j.mu.Lock()
 	defer j.mu.Unlock()
-	if err := j.mergeFrom(f); err != nil {
+	rev, err := j.mergeFromFile(f)
+	if err != nil {
 		// The cookie file is probably corrupt.
 		log.Printf("cannot read cookie file to merge it; ignoring it: %v", err)
 	}
+	j.lastRevision = rev
 	j.deleteExpired(now)
 	if err := f.Truncate(0); err != nil {
 		return errgo.Notef(err, "cannot truncate file")
@@ -57,17 +52,57 @@ func (j *Jar) save(now time.Time) error {
 	if _, err := f.Seek(0, 0); err != nil {
 		return errgo.Mask(err)
 	}
-	return j.writeTo(f)
+	if err := j.writeToFile(f); err != nil {
+		return errgo.Mask(err)
+	}
+	j.dirty = nil
+	return errgo.Mask(j.truncateJournal())
+}
+
+// saveWithStorage is like save but delegates locking and persistence
+// to storage instead of the built-in file+lock behaviour, bypassing
+// the advisory file lock entirely.
+func (j *Jar) saveWithStorage(now time.Time, storage Storage) error {
+	unlock, err := storage.Lock(context.Background())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer unlock.Close()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stored, err := storage.Load()
+	if err != nil {
+		log.Printf("cannot read cookie store to merge it; ignoring it: %v", err)
+	} else {
+		// mergeDirty, not merge: a plain merge would unconditionally
+		// overwrite any local SetCookies update to a pre-existing
+		// cookie with whatever another jar last stored, even with no
+		// concurrency involved (our own last Store is what's being
+		// loaded back here). StorageEntry carries no Updated time, so
+		// a stored copy of a cookie never outranks one in j.dirty;
+		// cookies not in j.dirty take the stored copy.
+		j.mergeDirty(storageToEntries(stored))
+	}
+	j.deleteExpired(now)
+	if err := storage.Store(entriesToStorage(j.allPersistentEntries())); err != nil {
+		return errgo.Mask(err)
+	}
+	j.dirty = nil
+	return nil
 }
 
 // load loads the cookies from j.filename. If the file does not exist,
 // no error will be returned and no cookies will be loaded.
 func (j *Jar) load() error {
-	releaser, err := lockFile(j.filename)
+	if j.storage != nil {
+		return j.loadWithStorage(j.storage)
+	}
+	unlock, err := lockFileTimeout(context.Background(), j.filename, j.lockTimeout)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	defer releaser.Release()
+	defer unlock.Close()
 	f, err := os.Open(j.filename)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -76,42 +111,31 @@ func (j *Jar) load() error {
 		return err
 	}
 	defer f.Close()
-	if err := j.mergeFrom(f); err != nil {
+	rev, err := j.mergeFromFile(f)
+	if err != nil {
 		return errgo.Mask(err)
 	}
-	return nil
+	j.lastRevision = rev
+	return errgo.Mask(j.replayJournal())
 }
 
-// mergeFrom reads all the cookies from r and stores them in the Jar.
-func (j *Jar) mergeFrom(r io.Reader) error {
-	decoder := json.NewDecoder(r)
-	// Cope with old cookiejar format by just discarding
-	// cookies, but still return an error if it's invalid JSON.
-	var data json.RawMessage
-	if err := decoder.Decode(&data); err != nil {
-		if err == io.EOF {
-			// Empty file.
-			return nil
-		}
-		return err
-	}
-	var entries []entry
-	if err := json.Unmarshal(data, &entries); err != nil {
-		log.Printf("warning: discarding cookies in invalid format (error: %v)", err)
-		return nil
+// loadWithStorage is like load but reads the initial contents from
+// storage instead of j.filename.
+func (j *Jar) loadWithStorage(storage Storage) error {
+	unlock, err := storage.Lock(context.Background())
+	if err != nil {
+		return errgo.Mask(err)
 	}
-	j.merge(entries)
-	return nil
-}
-
-// writeTo writes all the cookies in the jar to w
-// as a JSON array.
-func (j *Jar) writeTo(w io.Writer) error {
-	encoder := json.NewEncoder(w)
-	entries := j.allPersistentEntries()
-	if err := encoder.Encode(entries); err != nil {
-		return err
+	defer unlock.Close()
+	stored, err := storage.Load()
+	if err != nil {
+		return errgo.Mask(err)
 	}
+	// mergeDirty rather than merge for the same reason as
+	// saveWithStorage; at this point in a jar's life j.dirty is
+	// always empty, so this is equivalent to merge, but it keeps the
+	// two code paths consistent rather than relying on that.
+	j.mergeDirty(storageToEntries(stored))
 	return nil
 }
 
@@ -129,56 +153,3 @@ func (j *Jar) allPersistentEntries() []entry {
 	sort.Sort(byCanonicalHost{entries})
 	return entries
 }
-
-const maxRetryDuration = 2 * time.Second
-
-var re = regexp.MustCompile(`[^a-z0-9A-Z]*`)
-
-func lockNameFromPath(path string) (string, error) {
-	if path == "" {
-		return "", errors.New("path cannot be empty")
-	}
-	pathBytes := []byte(path)
-	hash := sha256.New()
-	hash.Write(pathBytes)
-	sha := base64.URLEncoding.EncodeToString(hash.Sum(nil))
-
-	if len(path) > 10 {
-		sliceIndex := len(path) - 10
-		path = path[sliceIndex:]
-	}
-	// We start with an alphabetical character, and remove non alphanumeric
-	// characters so that we can't have an invalid name for the lock.
-	final := re.ReplaceAllLiteralString(fmt.Sprintf("L%v%v", sha[:29], path), ``)
-	return final, nil
-}
-
-func lockFile(path string) (mutex.Releaser, error) {
-	retry := 100 * time.Microsecond
-	startTime := time.Now()
-	name, err := lockNameFromPath(path)
-	if err != nil {
-		return nil, err
-	}
-	spec := mutex.Spec{
-		Name:    name,
-		Clock:   clock.WallClock,
-		Delay:   retry,
-		Timeout: maxRetryDuration,
-	}
-	for {
-		releaser, err := mutex.Acquire(spec)
-		if err == nil {
-			return releaser, nil
-		}
-		total := time.Since(startTime)
-		if total > maxRetryDuration {
-			return nil, errgo.Notef(err, "file locked for too long; giving up")
-		}
-		// Always have at least one try at the end of the interval.
-		if remain := maxRetryDuration - total; retry > remain {
-			retry = remain
-		}
-		time.Sleep(retry)
-	}
-}
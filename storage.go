@@ -0,0 +1,174 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cookiejar
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Unlocker releases a lock acquired by Storage.Lock.
+type Unlocker = io.Closer
+
+// Storage is the persistence backend used by a Jar when
+// Options.Storage is set; when it is nil, the Jar uses its own
+// built-in file persistence on Options.Filename instead of any
+// Storage. Implementations must be safe to use from
+// multiple processes at once: Lock is held for the duration of a
+// Load/Store pair so that the read-modify-write isn't racy across
+// jars sharing the same backing store.
+type Storage interface {
+	// Lock acquires exclusive access to the store, returning an
+	// Unlocker that must be closed to release it.
+	Lock(ctx context.Context) (Unlocker, error)
+
+	// Load returns every entry currently in the store.
+	Load() ([]StorageEntry, error)
+
+	// Store replaces the store's contents with entries.
+	Store(entries []StorageEntry) error
+}
+
+// StorageEntry is the exported, backend-agnostic representation of a
+// single cookie, used at the Storage boundary so that backends
+// living in other packages don't need access to the unexported
+// entry type.
+type StorageEntry struct {
+	Name       string
+	Value      string
+	Domain     string
+	Path       string
+	Secure     bool
+	HttpOnly   bool
+	Persistent bool
+	HostOnly   bool
+	Expires    time.Time
+	Creation   time.Time
+	LastAccess time.Time
+}
+
+func entryToStorage(e entry) StorageEntry {
+	return StorageEntry{
+		Name:       e.Name,
+		Value:      e.Value,
+		Domain:     e.Domain,
+		Path:       e.Path,
+		Secure:     e.Secure,
+		HttpOnly:   e.HttpOnly,
+		Persistent: e.Persistent,
+		HostOnly:   e.HostOnly,
+		Expires:    e.Expires,
+		Creation:   e.Creation,
+		LastAccess: e.LastAccess,
+	}
+}
+
+func storageToEntry(s StorageEntry) entry {
+	return entry{
+		Name:       s.Name,
+		Value:      s.Value,
+		Domain:     s.Domain,
+		Path:       s.Path,
+		Secure:     s.Secure,
+		HttpOnly:   s.HttpOnly,
+		Persistent: s.Persistent,
+		HostOnly:   s.HostOnly,
+		Expires:    s.Expires,
+		Creation:   s.Creation,
+		LastAccess: s.LastAccess,
+	}
+}
+
+func entriesToStorage(entries []entry) []StorageEntry {
+	out := make([]StorageEntry, len(entries))
+	for i, e := range entries {
+		out[i] = entryToStorage(e)
+	}
+	return out
+}
+
+func storageToEntries(entries []StorageEntry) []entry {
+	out := make([]entry, len(entries))
+	for i, e := range entries {
+		out[i] = storageToEntry(e)
+	}
+	return out
+}
+
+// FileStorage is a file-backed Storage implementation: entries are
+// kept as a plain JSON array in a single file, which Store truncates
+// and rewrites, guarded by an advisory file lock. It is not the Jar's
+// built-in file persistence used when no Options.Storage is given:
+// that format carries a revision number, can be encrypted and has a
+// journal beside it, and FileStorage.Load does not read it.
+// It's useful when a caller wants file-backed storage but needs to
+// pass it through the Storage interface, e.g. to wrap it with their
+// own locking or caching layer.
+type FileStorage struct {
+	// Filename is the path to the cookie file.
+	Filename string
+
+	// LockTimeout bounds how long Lock waits for the advisory file
+	// lock before giving up. Defaults to defaultLockTimeout if zero.
+	LockTimeout time.Duration
+}
+
+// Lock acquires the advisory file lock described in lockFileTimeout,
+// on the sidecar "<Filename>.lock" file.
+func (s *FileStorage) Lock(ctx context.Context) (Unlocker, error) {
+	return lockFileTimeout(ctx, s.Filename, s.LockTimeout)
+}
+
+// Load reads and parses the cookie file, returning no entries (and
+// no error) if it doesn't exist yet.
+func (s *FileStorage) Load() ([]StorageEntry, error) {
+	f, err := os.Open(s.Filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	defer f.Close()
+	entries, err := decodeEntries(f)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return entriesToStorage(entries), nil
+}
+
+// Store truncates the cookie file and writes entries to it as plain
+// JSON.
+func (s *FileStorage) Store(entries []StorageEntry) error {
+	f, err := os.OpenFile(s.Filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	return encodeEntries(f, storageToEntries(entries))
+}
+
+// decodeEntries parses r as the plain JSON entry array format used
+// by FileStorage.Load.
+func decodeEntries(r io.Reader) ([]entry, error) {
+	var entries []entry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+// encodeEntries writes entries to w as a JSON array.
+func encodeEntries(w io.Writer, entries []entry) error {
+	return json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package memory provides a cookiejar.Storage implementation backed
+// by an in-process map, intended for use in tests that need a Jar
+// without touching the filesystem.
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/caeret/persistent-cookiejar"
+)
+
+// Storage is an in-memory cookiejar.Storage. The zero value is ready
+// to use. It's safe for concurrent use by multiple jars within the
+// same process, but (unlike FileStorage) provides no cross-process
+// guarantees, so it should only be used in tests.
+type Storage struct {
+	mu      sync.Mutex
+	entries []cookiejar.StorageEntry
+}
+
+// Lock acquires the in-process mutex guarding Storage.
+func (s *Storage) Lock(ctx context.Context) (cookiejar.Unlocker, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	return unlockFunc(s.mu.Unlock), nil
+}
+
+// Load returns a copy of the entries currently in the store.
+func (s *Storage) Load() ([]cookiejar.StorageEntry, error) {
+	out := make([]cookiejar.StorageEntry, len(s.entries))
+	copy(out, s.entries)
+	return out, nil
+}
+
+// Store replaces the store's contents with entries.
+func (s *Storage) Store(entries []cookiejar.StorageEntry) error {
+	s.entries = append(s.entries[:0], entries...)
+	return nil
+}
+
+type unlockFunc func()
+
+func (f unlockFunc) Close() error {
+	f()
+	return nil
+}
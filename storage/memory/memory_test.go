@@ -0,0 +1,61 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"context"
+	"testing"
+
+	cookiejar "github.com/caeret/persistent-cookiejar"
+)
+
+func TestStoreReplacesContents(t *testing.T) {
+	var s Storage
+
+	if err := s.Store([]cookiejar.StorageEntry{{Domain: "example.com", Name: "a"}}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := s.Store([]cookiejar.StorageEntry{{Domain: "example.com", Name: "b"}}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	got, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(got) != 1 || got[0].Name != "b" {
+		t.Fatalf("got %v, want only the most recently stored entry", got)
+	}
+}
+
+func TestLockExcludesConcurrentAccess(t *testing.T) {
+	var s Storage
+
+	unlock, err := s.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		u, err := s.Lock(context.Background())
+		if err != nil {
+			return
+		}
+		u.Close()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("second Lock succeeded while the first was still held")
+	default:
+	}
+
+	if err := unlock.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	<-acquired
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package redis provides a cookiejar.Storage implementation backed
+// by Redis, so that jars running in multiple processes (e.g. a pool
+// of scraper workers) can share a single cookie store.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/caeret/persistent-cookiejar"
+	"gopkg.in/errgo.v1"
+)
+
+// Client is the subset of a Redis client that Storage needs. It's
+// satisfied by most popular Redis client packages' command objects
+// without requiring this package to depend on any of them directly.
+type Client interface {
+	// SetNX sets key to value with the given TTL only if key
+	// doesn't already exist, reporting whether it was set.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Del deletes key.
+	Del(ctx context.Context, key string) error
+	// Get returns the value stored at key, or (nil, nil) if it
+	// doesn't exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set sets key to value with no expiry.
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// Storage is a cookiejar.Storage backed by Redis. Entries are stored
+// as a single JSON blob under Key, and Lock is implemented as a
+// SETNX-based lock under Key+".lock" with a TTL so that a crashed
+// holder doesn't wedge the store forever.
+type Storage struct {
+	Client Client
+
+	// Key is the Redis key entries are stored under.
+	Key string
+
+	// LockTTL bounds how long a lock may be held before it's
+	// considered abandoned and eligible to be stolen. Defaults to
+	// 10s if zero.
+	LockTTL time.Duration
+
+	// LockRetry is how long to wait between SETNX attempts while
+	// acquiring the lock. Defaults to 50ms if zero.
+	LockRetry time.Duration
+}
+
+const (
+	defaultLockTTL   = 10 * time.Second
+	defaultLockRetry = 50 * time.Millisecond
+)
+
+func (s *Storage) lockKey() string {
+	return s.Key + ".lock"
+}
+
+// Lock acquires the distributed lock, blocking (subject to ctx) until
+// it's free.
+func (s *Storage) Lock(ctx context.Context) (cookiejar.Unlocker, error) {
+	ttl := s.LockTTL
+	if ttl == 0 {
+		ttl = defaultLockTTL
+	}
+	retry := s.LockRetry
+	if retry == 0 {
+		retry = defaultLockRetry
+	}
+	key := s.lockKey()
+	for {
+		ok, err := s.Client.SetNX(ctx, key, []byte("1"), ttl)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if ok {
+			return unlocker{s.Client, key}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+type unlocker struct {
+	client Client
+	key    string
+}
+
+func (u unlocker) Close() error {
+	return errgo.Mask(u.client.Del(context.Background(), u.key))
+}
+
+// Load returns the entries currently stored under Key, or no entries
+// (and no error) if it doesn't exist yet.
+func (s *Storage) Load() ([]cookiejar.StorageEntry, error) {
+	data, err := s.Client.Get(context.Background(), s.Key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var entries []cookiejar.StorageEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return entries, nil
+}
+
+// Store replaces the entries stored under Key.
+func (s *Storage) Store(entries []cookiejar.StorageEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.Client.Set(context.Background(), s.Key, data))
+}
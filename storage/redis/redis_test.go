@@ -0,0 +1,102 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package redis
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	cookiejar "github.com/caeret/persistent-cookiejar"
+)
+
+// fakeClient is a minimal in-process Client, enough to exercise
+// Storage without a real Redis server.
+type fakeClient struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{data: make(map[string][]byte)}
+}
+
+func (c *fakeClient) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.data[key]; ok {
+		return false, nil
+	}
+	c.data[key] = value
+	return true, nil
+}
+
+func (c *fakeClient) Del(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+	return nil
+}
+
+func (c *fakeClient) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data[key], nil
+}
+
+func (c *fakeClient) Set(ctx context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key] = value
+	return nil
+}
+
+func TestStoreLoadRoundTrip(t *testing.T) {
+	s := &Storage{Client: newFakeClient(), Key: "cookies"}
+
+	if got, err := s.Load(); err != nil || len(got) != 0 {
+		t.Fatalf("Load before Store: got %v, %v", got, err)
+	}
+
+	entries := []cookiejar.StorageEntry{{Domain: "example.com", Path: "/", Name: "a", Value: "1"}}
+	if err := s.Store(entries); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	got, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(got) != 1 || got[0].Name != "a" || got[0].Value != "1" {
+		t.Fatalf("unexpected entries after Store: %v", got)
+	}
+}
+
+func TestLockExcludesUntilClosed(t *testing.T) {
+	s := &Storage{Client: newFakeClient(), Key: "cookies", LockRetry: time.Millisecond}
+
+	unlock, err := s.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("first Lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Lock(ctx); err == nil {
+		t.Fatalf("second Lock: want timeout while first is held, got nil")
+	}
+
+	if err := unlock.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	unlock2, err := s.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("Lock after release: %v", err)
+	}
+	if err := unlock2.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
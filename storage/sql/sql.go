@@ -0,0 +1,175 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sql provides a cookiejar.Storage implementation backed by
+// a SQL table, so that multiple jars (potentially in different
+// processes) can share cookies without the whole-file merge dance
+// that the file-backed storage needs.
+package sql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/caeret/persistent-cookiejar"
+	"gopkg.in/errgo.v1"
+)
+
+// Storage is a cookiejar.Storage backed by a SQL table. Entries are
+// upserted keyed by (host, path, name), and Store deletes every row
+// not among the entries it is given, so the table ends up holding
+// exactly those entries.
+//
+// The table is expected to already exist, with the schema:
+//
+//	CREATE TABLE <Table> (
+//		host        TEXT NOT NULL,
+//		path        TEXT NOT NULL,
+//		name        TEXT NOT NULL,
+//		value       TEXT NOT NULL,
+//		secure      BOOLEAN NOT NULL,
+//		http_only   BOOLEAN NOT NULL,
+//		persistent  BOOLEAN NOT NULL,
+//		host_only   BOOLEAN NOT NULL,
+//		expires     TIMESTAMP NOT NULL,
+//		creation    TIMESTAMP NOT NULL,
+//		last_access TIMESTAMP NOT NULL,
+//		PRIMARY KEY (host, path, name)
+//	)
+type Storage struct {
+	DB    *sql.DB
+	Table string
+
+	// LockTable names a single-row table used to serialize Lock
+	// across processes; it defaults to "<Table>_lock" if empty and
+	// is created on first use if it doesn't exist.
+	LockTable string
+}
+
+func (s *Storage) lockTable() string {
+	if s.LockTable != "" {
+		return s.LockTable
+	}
+	return s.Table + "_lock"
+}
+
+// Lock acquires a row-level lock on the single row in LockTable for
+// the duration of a Load/Store pair.
+func (s *Storage) Lock(ctx context.Context) (cookiejar.Unlocker, error) {
+	lockTable := s.lockTable()
+	if _, err := s.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+lockTable+` (id INTEGER PRIMARY KEY)`); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Seed the single row the lock contends on. Every call after the
+	// first hits a duplicate-key error here, which is expected and
+	// ignored: all that matters is the row exists before we try to
+	// lock it below.
+	_, _ = s.DB.ExecContext(ctx, `INSERT INTO `+lockTable+` (id) VALUES (1)`)
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// SELECT ... FOR UPDATE blocks (subject to ctx) until any other
+	// holder's transaction commits or rolls back, so this returns as
+	// soon as the lock is ours rather than needing its own retry loop.
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM `+lockTable+` WHERE id = 1 FOR UPDATE`); err != nil {
+		tx.Rollback()
+		return nil, errgo.Mask(err)
+	}
+	return txUnlocker{tx}, nil
+}
+
+type txUnlocker struct {
+	tx *sql.Tx
+}
+
+func (u txUnlocker) Close() error {
+	return errgo.Mask(u.tx.Commit())
+}
+
+// Load returns every entry in Table.
+func (s *Storage) Load() ([]cookiejar.StorageEntry, error) {
+	rows, err := s.DB.Query(`SELECT host, path, name, value, secure, http_only, persistent, host_only, expires, creation, last_access FROM ` + s.Table)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	var entries []cookiejar.StorageEntry
+	for rows.Next() {
+		var e cookiejar.StorageEntry
+		if err := rows.Scan(&e.Domain, &e.Path, &e.Name, &e.Value, &e.Secure, &e.HttpOnly, &e.Persistent, &e.HostOnly, &e.Expires, &e.Creation, &e.LastAccess); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, errgo.Mask(rows.Err())
+}
+
+// Store upserts entries into Table, keyed by (host, path, name), and
+// deletes any row not present in entries, so that cookies removed
+// locally (expired or cleared) don't get resurrected by the next
+// Load from another jar sharing the table.
+func (s *Storage) Store(entries []cookiejar.StorageEntry) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	keep := make([][3]string, 0, len(entries))
+	for _, e := range entries {
+		res, err := tx.Exec(`UPDATE `+s.Table+` SET value = ?, secure = ?, http_only = ?, persistent = ?, host_only = ?, expires = ?, creation = ?, last_access = ? WHERE host = ? AND path = ? AND name = ?`,
+			e.Value, e.Secure, e.HttpOnly, e.Persistent, e.HostOnly, e.Expires, e.Creation, e.LastAccess, e.Domain, e.Path, e.Name)
+		if err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		} else if n == 0 {
+			if _, err := tx.Exec(`INSERT INTO `+s.Table+` (host, path, name, value, secure, http_only, persistent, host_only, expires, creation, last_access) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				e.Domain, e.Path, e.Name, e.Value, e.Secure, e.HttpOnly, e.Persistent, e.HostOnly, e.Expires, e.Creation, e.LastAccess); err != nil {
+				tx.Rollback()
+				return errgo.Mask(err)
+			}
+		}
+		keep = append(keep, [3]string{e.Domain, e.Path, e.Name})
+	}
+	rows, err := tx.Query(`SELECT host, path, name FROM ` + s.Table)
+	if err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	var stale [][3]string
+	for rows.Next() {
+		var host, path, name string
+		if err := rows.Scan(&host, &path, &name); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+		found := false
+		for _, k := range keep {
+			if k[0] == host && k[1] == path && k[2] == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, [3]string{host, path, name})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	for _, k := range stale {
+		if _, err := tx.Exec(`DELETE FROM `+s.Table+` WHERE host = ? AND path = ? AND name = ?`, k[0], k[1], k[2]); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(tx.Commit())
+}
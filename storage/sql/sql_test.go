@@ -0,0 +1,110 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sql
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	cookiejar "github.com/caeret/persistent-cookiejar"
+	_ "modernc.org/sqlite"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE cookies (
+		host        TEXT NOT NULL,
+		path        TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		value       TEXT NOT NULL,
+		secure      BOOLEAN NOT NULL,
+		http_only   BOOLEAN NOT NULL,
+		persistent  BOOLEAN NOT NULL,
+		host_only   BOOLEAN NOT NULL,
+		expires     TIMESTAMP NOT NULL,
+		creation    TIMESTAMP NOT NULL,
+		last_access TIMESTAMP NOT NULL,
+		PRIMARY KEY (host, path, name)
+	)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	return db
+}
+
+func TestStoreUpsertsAndDeletesStaleRows(t *testing.T) {
+	db := openTestDB(t)
+	s := &Storage{DB: db, Table: "cookies"}
+
+	now := time.Now().Round(time.Second)
+	a := cookiejar.StorageEntry{Domain: "example.com", Path: "/", Name: "a", Value: "1", Expires: now, Creation: now, LastAccess: now}
+	b := cookiejar.StorageEntry{Domain: "example.com", Path: "/", Name: "b", Value: "2", Expires: now, Creation: now, LastAccess: now}
+
+	if err := s.Store([]cookiejar.StorageEntry{a, b}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	got, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d entries after first Store, want 2: %v", len(got), got)
+	}
+
+	// Storing without b should delete its row, not leave it behind.
+	a.Value = "1-updated"
+	if err := s.Store([]cookiejar.StorageEntry{a}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	got, err = s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d entries after second Store, want 1 (stale row not deleted): %v", len(got), got)
+	}
+	if got[0].Name != "a" || got[0].Value != "1-updated" {
+		t.Fatalf("unexpected surviving entry: %+v", got[0])
+	}
+}
+
+// TestLockSeedsRow checks the seeding step Lock relies on, by running
+// the same INSERT directly: the first insert of row 1 into the lock
+// table succeeds and leaves exactly one row, and a second one fails
+// with a duplicate-key error, which Lock ignores on every call after
+// the first. It does not call Lock itself: Lock's "SELECT ... FOR
+// UPDATE" needs a backend that supports it (Postgres, MySQL, ...),
+// and SQLite, used here for a dependency-free test, doesn't.
+func TestLockSeedsRow(t *testing.T) {
+	db := openTestDB(t)
+	lockTable := "cookies_lock"
+	if _, err := db.Exec(`CREATE TABLE ` + lockTable + ` (id INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatalf("create lock table: %v", err)
+	}
+	seed := func() error {
+		_, err := db.Exec(`INSERT INTO ` + lockTable + ` (id) VALUES (1)`)
+		return err
+	}
+	if err := seed(); err != nil {
+		t.Fatalf("first seed: %v", err)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + lockTable).Scan(&count); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d rows in lock table after seeding, want 1", count)
+	}
+	// Seeding again must fail with a duplicate-key error, which is
+	// the error Lock ignores for every call after the first.
+	if err := seed(); err == nil {
+		t.Fatalf("second seed: want duplicate key error, got nil")
+	}
+}